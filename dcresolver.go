@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// DNS record types used by DCResolver's lookups.
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+)
+
+// defaultDoHEndpoints are tried in order on every refresh until one answers.
+var defaultDoHEndpoints = []string{
+	"dns.google",
+	"cloudflare-dns.com",
+}
+
+// dcConfigSigningKey verifies an optional centrally-managed DC list fetched
+// from ProxyConfig.SignedDCConfigURL. It's a zero-value placeholder by
+// default; deployments that want that feature compile in their own
+// ed25519 public key here. An unset key simply disables the feature, falling
+// straight through to DoH resolution.
+var dcConfigSigningKey ed25519.PublicKey
+
+// doHSPKIPins maps a DoH resolver hostname to the base64 SHA-256 hash of its
+// certificate's SubjectPublicKeyInfo (the same "pin" format HPKP used). This
+// is the actual MITM defense for the DoH lookups: the uTLS fingerprint
+// dialPinnedTLS shapes the handshake with is DPI evasion only and, on its
+// own, verifies the peer with the host's normal CA trust store, which any
+// CA the box trusts can satisfy. It's a zero-value placeholder by default;
+// deployments that want MITM resistance on the DoH path compile in their own
+// pins here. A host with no configured pin simply isn't checked.
+var doHSPKIPins = map[string]string{}
+
+// spkiPin returns the base64 SHA-256 hash of cert's SubjectPublicKeyInfo.
+func spkiPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// signedDCConfig is the on-the-wire shape of a signed DC list document: the
+// signature covers the raw bytes of the "datacenters" field.
+type signedDCConfig struct {
+	Datacenters json.RawMessage `json:"datacenters"`
+	Signature   string          `json:"signature"` // base64 ed25519 signature
+}
+
+// DCResolver keeps TelegramDatacenters fresh, since Telegram periodically
+// rotates DC IPs (especially for CDN DCs) and the baked-in constants age
+// badly. Each refresh tries a signed config override first, then DNS-over-
+// HTTPS, and leaves the existing addresses in place if both fail.
+type DCResolver struct {
+	// NamePattern is the hostname queried for each DC, with '?' replaced by
+	// the DC ID, e.g. "apiv?.stel.com" resolves DC 2 as "apiv2.stel.com".
+	NamePattern string
+	// DoHEndpoints are tried in order until one answers.
+	DoHEndpoints []string
+	// SignedConfigURL, if set, is fetched and verified against
+	// dcConfigSigningKey ahead of DoH resolution on every refresh.
+	SignedConfigURL string
+
+	pool *ConnectionPool
+}
+
+// NewDCResolver builds a resolver that feeds refreshed DC addresses into
+// pool as well as the global TelegramDatacenters table.
+func NewDCResolver(pool *ConnectionPool, namePattern, signedConfigURL string) *DCResolver {
+	return &DCResolver{
+		NamePattern:     namePattern,
+		DoHEndpoints:    defaultDoHEndpoints,
+		SignedConfigURL: signedConfigURL,
+		pool:            pool,
+	}
+}
+
+// Start resolves once synchronously, so DC addresses are as fresh as
+// possible before the proxy starts accepting connections, then refreshes on
+// interval in the background.
+func (r *DCResolver) Start(interval time.Duration) {
+	r.refresh()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			r.refresh()
+		}
+	}()
+}
+
+func (r *DCResolver) refresh() {
+	if r.SignedConfigURL != "" {
+		dcs, err := r.fetchSignedConfig()
+		if err == nil {
+			r.apply(dcs, "signed-config")
+			return
+		}
+		log.Printf("DCResolver: signed config fetch failed, falling back to DoH: %v", err)
+	}
+
+	dcs := allDatacenters()
+	resolvedAny := false
+	for id, dc := range dcs {
+		host := strings.Replace(r.NamePattern, "?", strconv.Itoa(id), 1)
+		updated := dc
+
+		if ipv4, err := r.resolve(host, dnsTypeA); err == nil && ipv4 != "" {
+			updated.IPv4 = ipv4
+			resolvedAny = true
+		}
+		if ipv6, err := r.resolve(host, dnsTypeAAAA); err == nil && ipv6 != "" {
+			updated.IPv6 = ipv6
+			resolvedAny = true
+		}
+
+		dcs[id] = updated
+	}
+
+	if !resolvedAny {
+		log.Printf("DCResolver: all DoH resolvers failed, keeping existing DC addresses")
+		return
+	}
+	r.apply(dcs, "doh")
+}
+
+func (r *DCResolver) apply(dcs map[int]DCInfo, source string) {
+	for _, dc := range dcs {
+		setDatacenter(dc)
+		if r.pool != nil {
+			r.pool.UpdateDC(dc)
+		}
+	}
+	log.Printf("DCResolver: refreshed %d datacenter(s) from %s", len(dcs), source)
+}
+
+// resolve looks up one record type for host, trying each configured DoH
+// endpoint in turn until one of them answers.
+func (r *DCResolver) resolve(host string, qtype uint16) (string, error) {
+	query := buildDNSQuery(host, qtype)
+
+	var lastErr error
+	for _, endpoint := range r.DoHEndpoints {
+		addr, err := queryDoH(endpoint, query)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return addr, nil
+	}
+	return "", lastErr
+}
+
+// fetchSignedConfig retrieves and ed25519-verifies a centrally-managed DC
+// list, letting an operator override DC addresses without a code change.
+func (r *DCResolver) fetchSignedConfig() (map[int]DCInfo, error) {
+	if len(dcConfigSigningKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("no signing key configured")
+	}
+
+	resp, err := http.Get(r.SignedConfigURL)
+	if err != nil {
+		return nil, fmt.Errorf("fetch: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read: %v", err)
+	}
+
+	var cfg signedDCConfig
+	if err := json.Unmarshal(body, &cfg); err != nil {
+		return nil, fmt.Errorf("parse: %v", err)
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(cfg.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature encoding: %v", err)
+	}
+	if !ed25519.Verify(dcConfigSigningKey, cfg.Datacenters, sig) {
+		return nil, fmt.Errorf("signature verification failed")
+	}
+
+	var list []DCInfo
+	if err := json.Unmarshal(cfg.Datacenters, &list); err != nil {
+		return nil, fmt.Errorf("invalid datacenters payload: %v", err)
+	}
+
+	dcs := make(map[int]DCInfo, len(list))
+	for _, dc := range list {
+		dcs[dc.ID] = dc
+	}
+	return dcs, nil
+}
+
+// queryDoH sends a single DNS-over-HTTPS GET request (RFC 8484) to host over
+// a TLS connection dialed with a uTLS fingerprint (so the DoH lookup itself
+// blends into ordinary browser traffic instead of standing out to DPI) and,
+// where a pin is configured for host, a verified SPKI pin (so the lookup
+// also resists a MITM that holds a CA-trusted cert), then returns the first
+// matching A/AAAA address in the reply.
+func queryDoH(host string, query []byte) (string, error) {
+	conn, err := dialPinnedTLS(host, 10*time.Second)
+	if err != nil {
+		return "", fmt.Errorf("doh %s: dial: %v", host, err)
+	}
+	defer conn.Close()
+
+	encoded := base64.RawURLEncoding.EncodeToString(query)
+	req := fmt.Sprintf(
+		"GET /dns-query?dns=%s HTTP/1.1\r\nHost: %s\r\nAccept: application/dns-message\r\nConnection: close\r\n\r\n",
+		encoded, host)
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return "", fmt.Errorf("doh %s: write: %v", host, err)
+	}
+
+	body, err := readHTTPResponseBody(conn)
+	if err != nil {
+		return "", fmt.Errorf("doh %s: read: %v", host, err)
+	}
+
+	return parseDNSAnswer(body)
+}
+
+// dialPinnedTLS opens a TLS connection to host:443 with a fixed uTLS
+// ClientHello fingerprint instead of Go's stock crypto/tls, so the DoH query
+// can't be singled out and blocked by its handshake shape, then checks the
+// peer's certificate against doHSPKIPins[host] if a pin is configured for
+// it. The fingerprint alone only shapes the wire format; it still validates
+// the peer against the normal CA trust store, so the pin check is what
+// actually defends this connection against a MITM.
+func dialPinnedTLS(host string, timeout time.Duration) (net.Conn, error) {
+	raw, err := net.DialTimeout("tcp", host+":443", timeout)
+	if err != nil {
+		return nil, err
+	}
+	uconn := utls.UClient(raw, &utls.Config{ServerName: host}, utls.HelloChrome_Auto)
+	if err := uconn.Handshake(); err != nil {
+		raw.Close()
+		return nil, err
+	}
+
+	if pin, ok := doHSPKIPins[host]; ok {
+		certs := uconn.ConnectionState().PeerCertificates
+		if len(certs) == 0 || spkiPin(certs[0]) != pin {
+			uconn.Close()
+			return nil, fmt.Errorf("doh %s: certificate does not match pinned SPKI hash", host)
+		}
+	}
+
+	return uconn, nil
+}
+
+// readHTTPResponseBody reads just enough of a minimal HTTP/1.1 response to
+// return its body: the status line, headers (for Content-Length), then the
+// body itself.
+func readHTTPResponseBody(conn net.Conn) ([]byte, error) {
+	reader := bufio.NewReader(conn)
+	statusLine, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.Contains(statusLine, "200") {
+		return nil, fmt.Errorf("unexpected status: %s", strings.TrimSpace(statusLine))
+	}
+
+	contentLength := -1
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			break
+		}
+		lower := strings.ToLower(trimmed)
+		if strings.HasPrefix(lower, "content-length:") {
+			if n, err := strconv.Atoi(strings.TrimSpace(trimmed[len("content-length:"):])); err == nil {
+				contentLength = n
+			}
+		}
+	}
+
+	if contentLength >= 0 {
+		body := make([]byte, contentLength)
+		if _, err := io.ReadFull(reader, body); err != nil {
+			return nil, err
+		}
+		return body, nil
+	}
+	return io.ReadAll(reader)
+}
+
+// buildDNSQuery encodes a minimal single-question DNS-over-HTTPS query in
+// wire format (RFC 1035 section 4.1) with recursion desired and no EDNS.
+func buildDNSQuery(name string, qtype uint16) []byte {
+	var id [2]byte
+	rand.Read(id[:])
+
+	msg := make([]byte, 0, 16+len(name))
+	msg = append(msg, id[:]...)
+	msg = append(msg, 0x01, 0x00)               // flags: recursion desired
+	msg = binary.BigEndian.AppendUint16(msg, 1) // QDCOUNT
+	msg = binary.BigEndian.AppendUint16(msg, 0) // ANCOUNT
+	msg = binary.BigEndian.AppendUint16(msg, 0) // NSCOUNT
+	msg = binary.BigEndian.AppendUint16(msg, 0) // ARCOUNT
+
+	for _, label := range strings.Split(name, ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0x00)
+
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	msg = binary.BigEndian.AppendUint16(msg, 1) // QCLASS IN
+	return msg
+}
+
+// parseDNSAnswer walks a DNS-over-HTTPS wire-format response far enough to
+// pull the first A/AAAA record's address out of the answer section.
+func parseDNSAnswer(msg []byte) (string, error) {
+	if len(msg) < 12 {
+		return "", fmt.Errorf("dns: response too short")
+	}
+	qdcount := binary.BigEndian.Uint16(msg[4:6])
+	ancount := binary.BigEndian.Uint16(msg[6:8])
+
+	offset := 12
+	for i := 0; i < int(qdcount); i++ {
+		next, err := skipDNSName(msg, offset)
+		if err != nil {
+			return "", err
+		}
+		offset = next + 4 // QTYPE + QCLASS
+	}
+
+	for i := 0; i < int(ancount); i++ {
+		next, err := skipDNSName(msg, offset)
+		if err != nil {
+			return "", err
+		}
+		offset = next
+		if offset+10 > len(msg) {
+			return "", fmt.Errorf("dns: truncated answer record")
+		}
+		rtype := binary.BigEndian.Uint16(msg[offset : offset+2])
+		rdlength := int(binary.BigEndian.Uint16(msg[offset+8 : offset+10]))
+		offset += 10
+		if offset+rdlength > len(msg) {
+			return "", fmt.Errorf("dns: truncated answer data")
+		}
+		rdata := msg[offset : offset+rdlength]
+		offset += rdlength
+
+		switch {
+		case rtype == dnsTypeA && rdlength == 4:
+			return net.IP(rdata).String(), nil
+		case rtype == dnsTypeAAAA && rdlength == 16:
+			return net.IP(rdata).String(), nil
+		}
+	}
+
+	return "", fmt.Errorf("dns: no matching A/AAAA record in response")
+}
+
+// skipDNSName advances past a (possibly compressed) DNS name starting at
+// offset and returns the offset immediately after it.
+func skipDNSName(msg []byte, offset int) (int, error) {
+	for {
+		if offset >= len(msg) {
+			return 0, fmt.Errorf("dns: name runs past end of message")
+		}
+		length := msg[offset]
+		switch {
+		case length == 0:
+			return offset + 1, nil
+		case length&0xc0 == 0xc0: // compression pointer, always 2 bytes
+			return offset + 2, nil
+		default:
+			offset += 1 + int(length)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+// buildDNSResponse assembles a minimal well-formed DNS-over-HTTPS response:
+// one question and one answer record (using a compression pointer back to
+// the question name, as real resolvers do) carrying ip as an A or AAAA
+// record depending on its length.
+func buildDNSResponse(name string, qtype uint16, ip net.IP) []byte {
+	msg := make([]byte, 0, 64)
+	msg = append(msg, 0x00, 0x01) // ID
+	msg = append(msg, 0x81, 0x80) // flags: response, recursion available
+	msg = binary.BigEndian.AppendUint16(msg, 1) // QDCOUNT
+	msg = binary.BigEndian.AppendUint16(msg, 1) // ANCOUNT
+	msg = binary.BigEndian.AppendUint16(msg, 0) // NSCOUNT
+	msg = binary.BigEndian.AppendUint16(msg, 0) // ARCOUNT
+
+	questionStart := len(msg)
+	for _, label := range strings.Split(name, ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0x00)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	msg = binary.BigEndian.AppendUint16(msg, 1) // QCLASS IN
+
+	// Answer name: a compression pointer back to the question's name.
+	msg = append(msg, 0xc0, byte(questionStart))
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	msg = binary.BigEndian.AppendUint16(msg, 1) // CLASS IN
+	msg = binary.BigEndian.AppendUint32(msg, 300) // TTL
+	rdata := ip.To4()
+	if qtype == dnsTypeAAAA {
+		rdata = ip.To16()
+	}
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(rdata)))
+	msg = append(msg, rdata...)
+
+	return msg
+}
+
+func TestParseDNSAnswerValid(t *testing.T) {
+	ip := net.ParseIP("149.154.167.51")
+	msg := buildDNSResponse("apiv2.stel.com", dnsTypeA, ip)
+
+	got, err := parseDNSAnswer(msg)
+	if err != nil {
+		t.Fatalf("parseDNSAnswer: %v", err)
+	}
+	if got != ip.String() {
+		t.Errorf("parseDNSAnswer = %q, want %q", got, ip.String())
+	}
+}
+
+func TestParseDNSAnswerValidAAAA(t *testing.T) {
+	ip := net.ParseIP("2001:67c:4e8:f002::a")
+	msg := buildDNSResponse("apiv2.stel.com", dnsTypeAAAA, ip)
+
+	got, err := parseDNSAnswer(msg)
+	if err != nil {
+		t.Fatalf("parseDNSAnswer: %v", err)
+	}
+	if got != ip.String() {
+		t.Errorf("parseDNSAnswer = %q, want %q", got, ip.String())
+	}
+}
+
+func TestParseDNSAnswerMalformed(t *testing.T) {
+	valid := buildDNSResponse("apiv2.stel.com", dnsTypeA, net.ParseIP("1.2.3.4"))
+
+	cases := []struct {
+		name string
+		msg  []byte
+	}{
+		{"empty", nil},
+		{"shorter than header", valid[:8]},
+		{"truncated mid-answer", valid[:len(valid)-2]},
+		{"ancount lies", func() []byte {
+			// A CNAME answer (so parseDNSAnswer doesn't return before
+			// exhausting ancount) with ANCOUNT claiming a second answer
+			// that isn't actually in the message.
+			m := make([]byte, 0, 48)
+			m = append(m, 0x00, 0x01, 0x81, 0x80)
+			m = binary.BigEndian.AppendUint16(m, 1)
+			m = binary.BigEndian.AppendUint16(m, 2) // ANCOUNT: lies, only 1 present
+			m = binary.BigEndian.AppendUint16(m, 0)
+			m = binary.BigEndian.AppendUint16(m, 0)
+			m = append(m, 0x03, 'f', 'o', 'o', 0x00)
+			m = binary.BigEndian.AppendUint16(m, dnsTypeA)
+			m = binary.BigEndian.AppendUint16(m, 1)
+			m = append(m, 0xc0, 0x0c)
+			m = binary.BigEndian.AppendUint16(m, 5) // CNAME, not A/AAAA
+			m = binary.BigEndian.AppendUint16(m, 1)
+			m = binary.BigEndian.AppendUint32(m, 300)
+			m = binary.BigEndian.AppendUint16(m, 2)
+			m = append(m, 0x00, 0x00)
+			return m
+		}()},
+		{"rdlength overflows message", func() []byte {
+			m := append([]byte(nil), valid...)
+			binary.BigEndian.PutUint16(m[len(m)-6:len(m)-4], 0xffff)
+			return m
+		}()},
+		{"name runs past end of message", func() []byte {
+			m := append([]byte(nil), valid[:13]...)
+			m[12] = 0x3f // length byte claiming 63 more bytes that aren't there
+			return m
+		}()},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := parseDNSAnswer(c.msg); err == nil {
+				t.Errorf("parseDNSAnswer(%s): expected error, got nil", c.name)
+			}
+		})
+	}
+}
+
+func TestParseDNSAnswerNoMatchingRecord(t *testing.T) {
+	// A response whose only answer is neither a 4-byte A nor 16-byte AAAA
+	// record should be reported as "no matching record", not misparsed.
+	msg := make([]byte, 0, 64)
+	msg = append(msg, 0x00, 0x01, 0x81, 0x80)
+	msg = binary.BigEndian.AppendUint16(msg, 1)
+	msg = binary.BigEndian.AppendUint16(msg, 1)
+	msg = binary.BigEndian.AppendUint16(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, 0)
+	msg = append(msg, 0x03, 'f', 'o', 'o', 0x00)
+	msg = binary.BigEndian.AppendUint16(msg, dnsTypeA)
+	msg = binary.BigEndian.AppendUint16(msg, 1)
+	msg = append(msg, 0xc0, 0x0c)
+	msg = binary.BigEndian.AppendUint16(msg, 5) // CNAME, not A/AAAA
+	msg = binary.BigEndian.AppendUint16(msg, 1)
+	msg = binary.BigEndian.AppendUint32(msg, 300)
+	msg = binary.BigEndian.AppendUint16(msg, 2)
+	msg = append(msg, 0x00, 0x00)
+
+	if _, err := parseDNSAnswer(msg); err == nil {
+		t.Errorf("parseDNSAnswer: expected no-match error, got nil")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// buildTestClientHello assembles a minimal but well-formed ClientHello
+// record for use as test input: [record header][handshake header][version]
+// [random][session id][cipher suites][compression][extensions].
+func buildTestClientHello(random [32]byte, sessionID []byte, sni string, renegotiationInfo, ecPointFormats bool) []byte {
+	body := make([]byte, 0, 128)
+	body = binary.BigEndian.AppendUint16(body, TLSVersion12)
+	body = append(body, random[:]...)
+	body = append(body, byte(len(sessionID)))
+	body = append(body, sessionID...)
+
+	cipherSuites := []byte{0xc0, 0x2f} // TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+	body = binary.BigEndian.AppendUint16(body, uint16(len(cipherSuites)))
+	body = append(body, cipherSuites...)
+
+	body = append(body, 0x01, 0x00) // 1 compression method: none
+
+	var extensions []byte
+	if sni != "" {
+		name := []byte(sni)
+		serverNameEntry := append([]byte{0x00}, binary.BigEndian.AppendUint16(nil, uint16(len(name)))...)
+		serverNameEntry = append(serverNameEntry, name...)
+		serverNameList := binary.BigEndian.AppendUint16(nil, uint16(len(serverNameEntry)))
+		serverNameList = append(serverNameList, serverNameEntry...)
+		extensions = binary.BigEndian.AppendUint16(extensions, 0x0000)
+		extensions = binary.BigEndian.AppendUint16(extensions, uint16(len(serverNameList)))
+		extensions = append(extensions, serverNameList...)
+	}
+	if renegotiationInfo {
+		extensions = binary.BigEndian.AppendUint16(extensions, 0xff01)
+		extensions = binary.BigEndian.AppendUint16(extensions, 1)
+		extensions = append(extensions, 0x00)
+	}
+	if ecPointFormats {
+		extensions = binary.BigEndian.AppendUint16(extensions, 0x000b)
+		extensions = binary.BigEndian.AppendUint16(extensions, 2)
+		extensions = append(extensions, 0x01, 0x00)
+	}
+	body = binary.BigEndian.AppendUint16(body, uint16(len(extensions)))
+	body = append(body, extensions...)
+
+	handshake := make([]byte, 4+len(body))
+	handshake[0] = 0x01 // HandshakeType ClientHello
+	handshake[1] = byte(len(body) >> 16)
+	handshake[2] = byte(len(body) >> 8)
+	handshake[3] = byte(len(body))
+	copy(handshake[4:], body)
+
+	return wrapTLSRecord(TLSHandshakeType, handshake)
+}
+
+func TestParseClientHelloValid(t *testing.T) {
+	var random [32]byte
+	for i := range random {
+		random[i] = byte(i)
+	}
+	sessionID := []byte{0xaa, 0xbb, 0xcc}
+	record := buildTestClientHello(random, sessionID, "example.com", true, true)
+
+	info, err := parseClientHello(record)
+	if err != nil {
+		t.Fatalf("parseClientHello: %v", err)
+	}
+	if info.random != random {
+		t.Errorf("random = %x, want %x", info.random, random)
+	}
+	if !bytes.Equal(info.sessionID, sessionID) {
+		t.Errorf("sessionID = %x, want %x", info.sessionID, sessionID)
+	}
+	if info.sni != "example.com" {
+		t.Errorf("sni = %q, want %q", info.sni, "example.com")
+	}
+	if !info.renegotiationInfo {
+		t.Errorf("renegotiationInfo = false, want true")
+	}
+	if !info.ecPointFormats {
+		t.Errorf("ecPointFormats = false, want true")
+	}
+}
+
+func TestParseClientHelloMalformed(t *testing.T) {
+	var random [32]byte
+	full := buildTestClientHello(random, []byte{0x01}, "example.com", true, false)
+
+	cases := []struct {
+		name   string
+		record []byte
+	}{
+		{"empty", nil},
+		{"too short for header", []byte{0x16, 0x03, 0x03}},
+		{"wrong record type", func() []byte { r := append([]byte(nil), full...); r[0] = 0x17; return r }()},
+		{"truncated record", full[:len(full)-10]},
+		{"record length lies", func() []byte {
+			r := append([]byte(nil), full...)
+			binary.BigEndian.PutUint16(r[3:5], 0xffff)
+			return r
+		}()},
+		{"not a ClientHello message", func() []byte {
+			r := append([]byte(nil), full...)
+			r[5] = 0x02 // HandshakeType ServerHello
+			return r
+		}()},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := parseClientHello(c.record); err == nil {
+				t.Errorf("parseClientHello(%s): expected error, got nil", c.name)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// writeRawMuxFrame writes one mux frame directly to conn, bypassing
+// MuxSession.writeFrame, so tests can send headers a well-behaved peer never
+// would (e.g. a lying length field).
+func writeRawMuxFrame(t *testing.T, conn net.Conn, frameType byte, streamID, length uint32, payload []byte) {
+	t.Helper()
+	header := make([]byte, muxHeaderSize)
+	header[0] = frameType
+	binary.BigEndian.PutUint32(header[1:5], streamID)
+	binary.BigEndian.PutUint32(header[5:9], length)
+	if _, err := conn.Write(header); err != nil {
+		t.Fatalf("write frame header: %v", err)
+	}
+	if len(payload) > 0 {
+		if _, err := conn.Write(payload); err != nil {
+			t.Fatalf("write frame payload: %v", err)
+		}
+	}
+}
+
+// TestReadLoopRejectsOversizedFrame checks that a frame claiming a length
+// beyond maxMuxFrameLength closes the session instead of forcing a huge
+// allocation; a client could otherwise claim ~4GB in a single 9-byte header.
+func TestReadLoopRejectsOversizedFrame(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+
+	session := newMuxSession(serverConn, false, nil)
+	defer session.Close()
+
+	writeRawMuxFrame(t, clientConn, muxFrameData, 1, maxMuxFrameLength+1, nil)
+
+	clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1)
+	_, err := clientConn.Read(buf)
+	if err == nil {
+		t.Fatalf("expected the session to close the connection after an oversized frame length")
+	}
+}
+
+// TestMuxSessionOpenDataClose exercises the normal open/data/close frame
+// flow end to end over a net.Pipe-backed session.
+func TestMuxSessionOpenDataClose(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+
+	session := newMuxSession(serverConn, false, nil)
+	defer session.Close()
+
+	writeRawMuxFrame(t, clientConn, muxFrameOpen, 7, 0, nil)
+
+	stream, err := session.AcceptStream()
+	if err != nil {
+		t.Fatalf("AcceptStream: %v", err)
+	}
+	if stream.id != 7 {
+		t.Fatalf("stream.id = %d, want 7", stream.id)
+	}
+
+	payload := []byte("hello")
+	writeRawMuxFrame(t, clientConn, muxFrameData, 7, uint32(len(payload)), payload)
+
+	buf := make([]byte, len(payload))
+	stream.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		t.Fatalf("stream.Read: %v", err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("stream payload = %q, want %q", buf, "hello")
+	}
+
+	writeRawMuxFrame(t, clientConn, muxFrameClose, 7, 0, nil)
+	time.Sleep(50 * time.Millisecond)
+	if _, err := stream.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("stream.Read after close = %v, want io.EOF", err)
+	}
+}
+
+func TestAuthenticateRelayRoundTrip(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- authenticateRelay(serverConn, "correct-token") }()
+
+	if err := authenticateEdge(clientConn, "correct-token"); err != nil {
+		t.Fatalf("authenticateEdge: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("authenticateRelay: %v", err)
+	}
+}
+
+func TestAuthenticateRelayRejectsWrongToken(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- authenticateRelay(serverConn, "correct-token") }()
+
+	if err := authenticateEdge(clientConn, "wrong-token"); err != nil {
+		t.Fatalf("authenticateEdge: %v", err)
+	}
+	if err := <-done; err == nil {
+		t.Fatalf("authenticateRelay: expected a mismatch error, got nil")
+	}
+}
+
+func TestAuthenticateRelayRejectsOversizedToken(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- authenticateRelay(serverConn, "correct-token") }()
+
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], peerAuthTokenMaxLen+1)
+	if _, err := clientConn.Write(length[:]); err != nil {
+		t.Fatalf("write oversized length: %v", err)
+	}
+
+	if err := <-done; err == nil {
+		t.Fatalf("authenticateRelay: expected a too-large error, got nil")
+	}
+}
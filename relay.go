@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// relayBufferPool recycles the BufferSize byte slices used by relayData's
+// read loop, instead of allocating a fresh 64 KiB buffer per goroutine on
+// every connection.
+var relayBufferPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, BufferSize)
+	},
+}
+
+func getRelayBuffer() []byte {
+	return relayBufferPool.Get().([]byte)
+}
+
+func putRelayBuffer(buf []byte) {
+	relayBufferPool.Put(buf) //nolint:staticcheck // buf is reused at its original capacity
+}
+
+// canSplice reports whether src and dst are both plain TCP connections with
+// no FakeTLS record wrapping in play, in which case io.Copy can hand the
+// pair to the kernel's splice(2) on Linux instead of copying through a
+// userspace buffer at all.
+func canSplice(src, dst net.Conn, fakeTLS bool) (*net.TCPConn, *net.TCPConn, bool) {
+	if fakeTLS {
+		return nil, nil, false
+	}
+	srcTCP, srcOK := src.(*net.TCPConn)
+	dstTCP, dstOK := dst.(*net.TCPConn)
+	return srcTCP, dstTCP, srcOK && dstOK
+}
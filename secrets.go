@@ -0,0 +1,337 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// secretEntry is one user record loaded from the credentials file: a name,
+// a derived Secret, and the optional limits that gate it.
+type secretEntry struct {
+	Name             string
+	Secret           Secret
+	ExpiresAt        time.Time // zero means no expiry
+	MonthlyByteQuota uint64    // 0 means unlimited
+	AllowedDCs       map[int]bool
+
+	mutex        sync.Mutex
+	bytesUsed    uint64
+	quotaResetAt time.Time
+}
+
+// credentialRecord is the on-disk JSON shape of a single user in the
+// credentials file.
+type credentialRecord struct {
+	Name             string `json:"name"`
+	SecretHex        string `json:"secret-hex"`
+	ExpiresAt        string `json:"expiry,omitempty"`
+	MonthlyByteQuota uint64 `json:"monthly-byte-quota,omitempty"`
+	AllowedDCs       []int  `json:"allowed-dcs,omitempty"`
+}
+
+// SecretStore holds the multi-user credential set loaded from a file,
+// supporting hot-reload on SIGHUP so operators can add/revoke users without
+// restarting the proxy.
+type SecretStore struct {
+	path  string
+	mutex sync.RWMutex
+	users map[string]*secretEntry
+}
+
+// NewSecretStore loads credentials from path and starts watching for SIGHUP
+// to trigger a reload.
+func NewSecretStore(path string) (*SecretStore, error) {
+	store := &SecretStore{path: path}
+	if err := store.Reload(); err != nil {
+		return nil, err
+	}
+	go store.watchSignals()
+	return store, nil
+}
+
+func (s *SecretStore) watchSignals() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	for range sighup {
+		if err := s.Reload(); err != nil {
+			log.Printf("SecretStore: failed to reload %s: %v", s.path, err)
+			continue
+		}
+		log.Printf("SecretStore: reloaded credentials from %s", s.path)
+	}
+}
+
+// Reload re-reads the credentials file, replacing the in-memory user set.
+// Per-user usage counters are preserved across reload for users that still
+// exist so a SIGHUP doesn't reset quotas.
+func (s *SecretStore) Reload() error {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("read credentials file: %v", err)
+	}
+
+	var records []credentialRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return fmt.Errorf("parse credentials file: %v", err)
+	}
+
+	users := make(map[string]*secretEntry, len(records))
+	for _, rec := range records {
+		entry, err := newSecretEntry(rec)
+		if err != nil {
+			return fmt.Errorf("user %q: %v", rec.Name, err)
+		}
+		users[rec.Name] = entry
+	}
+
+	s.mutex.Lock()
+	for name, existing := range s.users {
+		if updated, ok := users[name]; ok {
+			existing.mutex.Lock()
+			updated.bytesUsed = existing.bytesUsed
+			updated.quotaResetAt = existing.quotaResetAt
+			existing.mutex.Unlock()
+		}
+	}
+	s.users = users
+	s.mutex.Unlock()
+
+	return nil
+}
+
+func newSecretEntry(rec credentialRecord) (*secretEntry, error) {
+	if rec.Name == "" {
+		return nil, fmt.Errorf("missing name")
+	}
+
+	secret, err := parseSecret(rec.SecretHex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret-hex: %v", err)
+	}
+
+	entry := &secretEntry{
+		Name:             rec.Name,
+		Secret:           secret,
+		MonthlyByteQuota: rec.MonthlyByteQuota,
+		quotaResetAt:     time.Now().AddDate(0, 1, 0),
+	}
+
+	if rec.ExpiresAt != "" {
+		expiry, err := time.Parse(time.RFC3339, rec.ExpiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expiry: %v", err)
+		}
+		entry.ExpiresAt = expiry
+	}
+
+	if len(rec.AllowedDCs) > 0 {
+		entry.AllowedDCs = make(map[int]bool, len(rec.AllowedDCs))
+		for _, dc := range rec.AllowedDCs {
+			entry.AllowedDCs[dc] = true
+		}
+	}
+
+	return entry, nil
+}
+
+// All returns a snapshot of every configured user, for the admin API.
+func (s *SecretStore) All() []*secretEntry {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	all := make([]*secretEntry, 0, len(s.users))
+	for _, entry := range s.users {
+		all = append(all, entry)
+	}
+	return all
+}
+
+// FindByFakeTLSRandom tries every configured user's secret against a FakeTLS
+// client random until one validates, returning the matching user.
+func (s *SecretStore) FindByFakeTLSRandom(random [32]byte, antiReplayEnabled bool) (*secretEntry, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, entry := range s.users {
+		if entry.expired() {
+			continue
+		}
+		if verifyFakeTLSRandomWithKey(entry.Secret.Key, random, antiReplayEnabled) {
+			return entry, true
+		}
+	}
+	return nil, false
+}
+
+// FindByObfuscatedHandshake tries every configured user's secret as the key
+// for the obfuscated2 handshake until the decrypted transport marker looks
+// valid, returning the matching user and the obfuscator built from its key.
+func (s *SecretStore) FindByObfuscatedHandshake(handshake []byte) (*secretEntry, []byte, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, entry := range s.users {
+		if entry.expired() {
+			continue
+		}
+		obf, err := NewObfuscator(entry.Secret, handshake)
+		if err != nil {
+			continue
+		}
+		decrypted := obf.Decrypt(handshake)
+		if looksLikeValidTransport(decrypted) {
+			return entry, decrypted, true
+		}
+	}
+	return nil, nil, false
+}
+
+func looksLikeValidTransport(decrypted []byte) bool {
+	if len(decrypted) < 4 {
+		return false
+	}
+	marker := uint32(decrypted[0]) | uint32(decrypted[1])<<8 | uint32(decrypted[2])<<16 | uint32(decrypted[3])<<24
+	return marker == TransportPadded || marker == TransportIntermediate
+}
+
+func (e *secretEntry) expired() bool {
+	return !e.ExpiresAt.IsZero() && time.Now().After(e.ExpiresAt)
+}
+
+// dcAllowed reports whether this user may be routed to the given datacenter.
+func (e *secretEntry) dcAllowed(dcID int) bool {
+	if len(e.AllowedDCs) == 0 {
+		return true
+	}
+	return e.AllowedDCs[dcID]
+}
+
+// quotaRemaining returns the number of bytes left in the current monthly
+// window, or -1 if the user has no quota configured.
+func (e *secretEntry) quotaRemaining() int64 {
+	if e.MonthlyByteQuota == 0 {
+		return -1
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.resetIfExpiredLocked()
+	remaining := int64(e.MonthlyByteQuota) - int64(e.bytesUsed)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return remaining
+}
+
+// addUsage records n transferred bytes for this user and reports whether the
+// user is still within quota.
+func (e *secretEntry) addUsage(n int) bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.resetIfExpiredLocked()
+	e.bytesUsed += uint64(n)
+	return e.MonthlyByteQuota == 0 || e.bytesUsed <= e.MonthlyByteQuota
+}
+
+func (e *secretEntry) resetIfExpiredLocked() {
+	if time.Now().After(e.quotaResetAt) {
+		e.bytesUsed = 0
+		e.quotaResetAt = time.Now().AddDate(0, 1, 0)
+	}
+}
+
+func (e *secretEntry) reset() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.bytesUsed = 0
+	e.quotaResetAt = time.Now().AddDate(0, 1, 0)
+}
+
+// usage returns the bytes transferred so far in the current quota window.
+// Relay goroutines mutate bytesUsed under e.mutex via addUsage, so the admin
+// API must go through this instead of reading the field directly.
+func (e *secretEntry) usage() uint64 {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.bytesUsed
+}
+
+// registerAdminRoutes mounts the /users admin API on mux, guarded by a
+// bearer token so operators (not random internet traffic hitting the
+// metrics port) can inspect and reset per-user quotas.
+func (p *MTProtoProxy) registerAdminRoutes(mux *http.ServeMux) {
+	if p.secretStore == nil || p.config.AdminToken == "" {
+		return
+	}
+
+	requireAdmin := func(h http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			auth := r.Header.Get("Authorization")
+			want := "Bearer " + p.config.AdminToken
+			if subtle.ConstantTimeCompare([]byte(auth), []byte(want)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			h(w, r)
+		}
+	}
+
+	mux.HandleFunc("/users", requireAdmin(p.handleListUsers))
+	mux.HandleFunc("/users/", requireAdmin(p.handleResetUser))
+}
+
+type userStatus struct {
+	Name           string `json:"name"`
+	BytesUsed      uint64 `json:"bytes_used"`
+	MonthlyQuota   uint64 `json:"monthly_byte_quota"`
+	QuotaRemaining int64  `json:"quota_remaining_bytes"`
+	Expired        bool   `json:"expired"`
+}
+
+func (p *MTProtoProxy) handleListUsers(w http.ResponseWriter, r *http.Request) {
+	entries := p.secretStore.All()
+	statuses := make([]userStatus, 0, len(entries))
+	for _, e := range entries {
+		statuses = append(statuses, userStatus{
+			Name:           e.Name,
+			BytesUsed:      e.usage(),
+			MonthlyQuota:   e.MonthlyByteQuota,
+			QuotaRemaining: e.quotaRemaining(),
+			Expired:        e.expired(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
+
+func (p *MTProtoProxy) handleResetUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rest := strings.TrimPrefix(r.URL.Path, "/users/")
+	name := strings.TrimSuffix(rest, "/reset")
+	if name == rest || name == "" {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	for _, e := range p.secretStore.All() {
+		if e.Name == name {
+			e.reset()
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	http.Error(w, "unknown user", http.StatusNotFound)
+}